@@ -22,19 +22,26 @@ package gen
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"go/ast"
+	"go/format"
+	"go/importer"
 	"go/parser"
 	"go/printer"
 	"go/token"
 	"go/types"
 	"io"
+	"io/ioutil"
 	"reflect"
+	"sort"
 	"strings"
 	"text/template"
 
 	"go.uber.org/thriftrw/compile"
+	"go.uber.org/thriftrw/gen/rewrite"
 	"go.uber.org/thriftrw/internal/curry"
+	"go.uber.org/thriftrw/internal/remap"
 	"go.uber.org/thriftrw/version"
 )
 
@@ -61,6 +68,13 @@ type Generator interface {
 	// declarations that have not been written so far.
 	DeclareFromTemplate(s string, data interface{}, opts ...TemplateOption) error
 
+	// DeclareGrouped is like DeclareFromTemplate, except the declarations it
+	// produces are tagged with the name of the Thrift type that owns them
+	// (for example, a struct or service name). Write uses this to keep a
+	// type's constructor and methods adjacent to each other instead of
+	// interleaving them with unrelated declarations.
+	DeclareGrouped(owner, s string, data interface{}, opts ...TemplateOption) error
+
 	// EnsureDeclared is similar to DeclareFromTemplate except that it simply
 	// ignores conflicting definitions.
 	EnsureDeclared(s string, data interface{}, opts ...TemplateOption) error
@@ -91,6 +105,92 @@ type Generator interface {
 	//
 	// The FileSet argument is deprecated and will be ignored.
 	Write(w io.Writer, _ *token.FileSet) error
+
+	// WriteWithRemap behaves like Write, except that when previous is
+	// non-nil, it is treated as the result of a prior Write call for this
+	// same file. The new output is remapped against previous (see the
+	// internal/remap package) so that hand-edited annotations -- such as
+	// "//go:generate" directives, build tags, or "// keep" comments --
+	// living in spans that did not change are carried over into the new
+	// output instead of being silently dropped. If the new output is
+	// byte-for-byte identical to previous, nothing is written to w.
+	WriteWithRemap(w io.Writer, previous []byte) error
+}
+
+// Plugin is the interface implemented by packages that extend the code
+// thriftrw generates for a Thrift file.
+//
+// Modeled on gqlgen's plugin system, the only method every plugin must
+// implement is Name. A plugin opts into the rest of the generation
+// lifecycle by additionally implementing one or more of the interfaces
+// below: OptionsMutator, TemplateFuncsPlugin, StructPlugin, ServicePlugin,
+// and PostWritePlugin. This lets callers add JSON tags, OpenTelemetry
+// spans, validators, or protobuf-compat marshalers without forking the
+// built-in templates.
+type Plugin interface {
+	// Name identifies the plugin. It appears in error messages and does
+	// not need to be unique, but should be descriptive.
+	Name() string
+}
+
+// OptionsMutator is implemented by plugins that need to adjust
+// GeneratorOptions before generation starts, for example to force NoZap
+// or register additional reserved names.
+type OptionsMutator interface {
+	Plugin
+
+	MutateOptions(*GeneratorOptions)
+}
+
+// TemplateFuncsPlugin is implemented by plugins that contribute additional
+// functions to the templates used to render generated code. The returned
+// FuncMap is merged into the built-in functions made available to every
+// template rendered by TextTemplate.
+type TemplateFuncsPlugin interface {
+	Plugin
+
+	TemplateFuncs(Generator) template.FuncMap
+}
+
+// StructPlugin is implemented by plugins that want to contribute
+// declarations alongside a generated struct, such as extra methods or
+// marker types.
+type StructPlugin interface {
+	Plugin
+
+	GenerateStruct(g Generator, s *compile.StructSpec) error
+}
+
+// ServicePlugin is implemented by plugins that want to contribute
+// declarations alongside a generated service, such as middleware or
+// tracing wrappers.
+type ServicePlugin interface {
+	Plugin
+
+	GenerateService(g Generator, s *compile.ServiceSpec) error
+}
+
+// GeneratedFile describes a single file written by a Generator. It is
+// handed to PostWritePlugin implementations once a package has finished
+// generating.
+type GeneratedFile struct {
+	// Name of the file, relative to the package directory.
+	Name string
+
+	// Contents of the file as written to disk.
+	Contents []byte
+}
+
+// PostWritePlugin is implemented by plugins that want to inspect or act on
+// a generated file once its contents are final, for example to run an
+// external formatter or emit a manifest. PostWrite is called once per Write
+// call, with the single file that call produced; a plugin that wants to
+// act on a whole package's worth of files must accumulate them itself
+// across calls.
+type PostWritePlugin interface {
+	Plugin
+
+	PostWrite(pkgDir string, files []GeneratedFile) error
 }
 
 var _typeOfGenerator = reflect.TypeOf((*Generator)(nil)).Elem()
@@ -130,14 +230,19 @@ type generator struct {
 	e              equalsGenerator
 	z              zapGenerator
 	noZap          bool
-	decls          []ast.Decl
+	decls          []declGroup
 	thriftImporter ThriftPackageImporter
 	mangler        *mangler
+	plugins        []Plugin
+	extraReserved  map[string]struct{}
+	formatter      func([]byte) ([]byte, error)
+
+	rewritePaths     []string
+	rewriteTemplates []*rewrite.Template
+	rewritesLoaded   bool
 
 	counter int
 	fset    *token.FileSet
-
-	// TODO use something to group related decls together
 }
 
 // GeneratorOptions controls a generator's behavior
@@ -147,11 +252,46 @@ type GeneratorOptions struct {
 	PackageName string
 
 	NoZap bool
+
+	// Plugins extend the generator with third-party behavior. See the
+	// Plugin interface for the hooks a plugin may implement.
+	Plugins []Plugin
+
+	// ExtraReservedNames lists additional identifiers, beyond the ones the
+	// built-in templates already reserve for themselves (see
+	// reservedTemplateNames), that generated code must not declare or
+	// import under. Use this when a Plugin or a custom template introduces
+	// its own template-internal names that a Thrift field or a `go.name`
+	// annotation could otherwise collide with.
+	ExtraReservedNames []string
+
+	// Formatter formats the final rendered file before it is written out.
+	// It defaults to go/format.Source. Set this to plug in an alternative
+	// formatter such as gofumpt or golang.org/x/tools/imports.
+	Formatter func([]byte) ([]byte, error)
+
+	// Rewrites lists paths to gen/rewrite template files. Each template
+	// applies its before/after rewrite to every generated declaration
+	// before it is written out, letting users apply cross-cutting policy
+	// changes -- extra nil checks, allocation elision, tracing wrappers --
+	// without forking the built-in templates.
+	Rewrites []string
 }
 
 // NewGenerator sets up a new generator for Go code.
 func NewGenerator(o *GeneratorOptions) Generator {
 	// TODO(abg): Determine package name from `namespace go` directive.
+	for _, p := range o.Plugins {
+		if om, ok := p.(OptionsMutator); ok {
+			om.MutateOptions(o)
+		}
+	}
+
+	extraReserved := make(map[string]struct{}, len(o.ExtraReservedNames))
+	for _, name := range o.ExtraReservedNames {
+		extraReserved[name] = struct{}{}
+	}
+
 	namespace := NewNamespace()
 	return &generator{
 		PackageName:    o.PackageName,
@@ -162,9 +302,45 @@ func NewGenerator(o *GeneratorOptions) Generator {
 		thriftImporter: o.Importer,
 		fset:           token.NewFileSet(),
 		noZap:          o.NoZap,
+		plugins:        o.Plugins,
+		extraReserved:  extraReserved,
+		formatter:      o.Formatter,
+		rewritePaths:   o.Rewrites,
 	}
 }
 
+// reservedTemplateNames maps identifiers that the built-in ToWire/FromWire/
+// Equals/Zap* templates rely on internally to a short description of where
+// they're used. A Thrift field or an annotation-provided `go.name` that
+// happens to match one of these would otherwise silently shadow the
+// template-internal identifier and produce miscompiling generated code.
+var reservedTemplateNames = map[string]string{
+	"err": "the error return of the generated ToWire/FromWire methods",
+	"w":   "the io.Writer parameter of the generated ToWire methods",
+	"v":   "the wire.Value parameter of the generated FromWire methods",
+	"sr":  "the struct reader used by the generated FromWire methods",
+	"lh":  "the left-hand side parameter of the generated Equals methods",
+	"rhs": "the right-hand side parameter of the generated Equals methods",
+	"x":   "the loop variable used by the generated Zap* encoders",
+}
+
+// checkReservedName returns an error if name collides with an identifier
+// reserved by the built-in runtime templates or by
+// GeneratorOptions.ExtraReservedNames.
+func (g *generator) checkReservedName(name string) error {
+	if why, ok := reservedTemplateNames[name]; ok {
+		return fmt.Errorf(
+			"generated code cannot declare or import %q: that name is reserved for %s",
+			name, why)
+	}
+	if _, ok := g.extraReserved[name]; ok {
+		return fmt.Errorf(
+			"generated code cannot declare or import %q: reserved by GeneratorOptions.ExtraReservedNames",
+			name)
+	}
+	return nil
+}
+
 // checkNoZap returns whether the NoZap flag is passed.
 func checkNoZap(g Generator) bool {
 	if gen, ok := g.(*generator); ok {
@@ -243,6 +419,16 @@ func (g *generator) TextTemplate(s string, data interface{}, opts ...TemplateOpt
 		"zapMarshalerPtr":  curryGenerator(g.z.zapMarshalerPtr, g),
 	}
 
+	for _, p := range g.plugins {
+		tfp, ok := p.(TemplateFuncsPlugin)
+		if !ok {
+			continue
+		}
+		for name, fn := range tfp.TemplateFuncs(g) {
+			templateFuncs[name] = curryGenerator(fn, g)
+		}
+	}
+
 	tmpl := template.New("thriftrw").Delims("<", ">").Funcs(templateFuncs)
 	for _, opt := range opts {
 		tmpl = opt(g, tmpl)
@@ -279,7 +465,13 @@ func (g *generator) recordGenDeclNames(d *ast.GenDecl) (conflict bool, err error
 	switch d.Tok {
 	case token.IMPORT:
 		for _, spec := range d.Specs {
-			if err := g.AddImportSpec(spec.(*ast.ImportSpec)); err != nil {
+			importSpec := spec.(*ast.ImportSpec)
+			if importSpec.Name != nil {
+				if err := g.checkReservedName(importSpec.Name.Name); err != nil {
+					return true, err
+				}
+			}
+			if err := g.AddImportSpec(importSpec); err != nil {
 				return false, fmt.Errorf(
 					"could not add explicit import %s: %v", spec, err,
 				)
@@ -288,6 +480,9 @@ func (g *generator) recordGenDeclNames(d *ast.GenDecl) (conflict bool, err error
 	case token.CONST:
 		for _, spec := range d.Specs {
 			for _, name := range spec.(*ast.ValueSpec).Names {
+				if err := g.checkReservedName(name.Name); err != nil {
+					return true, err
+				}
 				if err := g.Reserve(name.Name); err != nil {
 					return true, fmt.Errorf(
 						"could not declare constant %q: %v", name.Name, err,
@@ -298,6 +493,9 @@ func (g *generator) recordGenDeclNames(d *ast.GenDecl) (conflict bool, err error
 	case token.TYPE:
 		for _, spec := range d.Specs {
 			name := spec.(*ast.TypeSpec).Name.Name
+			if err := g.checkReservedName(name); err != nil {
+				return true, err
+			}
 			if err := g.Reserve(name); err != nil {
 				return true, fmt.Errorf("could not declare type %q: %v", name, err)
 			}
@@ -305,6 +503,9 @@ func (g *generator) recordGenDeclNames(d *ast.GenDecl) (conflict bool, err error
 	case token.VAR:
 		for _, spec := range d.Specs {
 			for _, name := range spec.(*ast.ValueSpec).Names {
+				if err := g.checkReservedName(name.Name); err != nil {
+					return true, err
+				}
 				if err := g.Reserve(name.Name); err != nil {
 					return true, fmt.Errorf(
 						"could not declare var %q: %v", name.Name, err,
@@ -406,7 +607,7 @@ func (g *generator) recordGenDeclNames(d *ast.GenDecl) (conflict bool, err error
 // this NEXT to the thing being documented.
 //
 //   <formatDoc .Doc>type Foo
-func (g *generator) declare(ignoreConflicts bool, s string, data interface{}, opts ...TemplateOption) error {
+func (g *generator) declare(ignoreConflicts bool, owner, s string, data interface{}, opts ...TemplateOption) error {
 	bs, err := g.renderTemplate(s, data, opts...)
 	if err != nil {
 		return err
@@ -422,6 +623,15 @@ func (g *generator) declare(ignoreConflicts bool, s string, data interface{}, op
 		case *ast.FuncDecl:
 			name := d.Name.Name
 
+			if d.Recv == nil {
+				if err := g.checkReservedName(name); err != nil {
+					if ignoreConflicts {
+						continue
+					}
+					return err
+				}
+			}
+
 			if d.Recv != nil {
 				// We record methods as ":$receiverType:$method". Although there will only
 				// ever be one receiver in the field list, we'll iterate through them
@@ -448,28 +658,55 @@ func (g *generator) declare(ignoreConflicts bool, s string, data interface{}, op
 		default:
 			// No special behavior. Move along.
 		}
-		g.appendDecl(decl)
+		g.appendDeclGrouped(owner, decl)
 	}
 
 	return nil
 }
 
 func (g *generator) DeclareFromTemplate(s string, data interface{}, opts ...TemplateOption) error {
-	return g.declare(false, s, data, opts...)
+	return g.declare(false, "", s, data, opts...)
 }
 
 func (g *generator) EnsureDeclared(s string, data interface{}, opts ...TemplateOption) error {
-	return g.declare(true, s, data, opts...)
+	return g.declare(true, "", s, data, opts...)
+}
+
+func (g *generator) DeclareGrouped(owner, s string, data interface{}, opts ...TemplateOption) error {
+	if err := g.declare(false, owner, s, data, opts...); err != nil {
+		return err
+	}
+	return g.dispatchGroupedPlugins(data)
+}
+
+// dispatchGroupedPlugins runs the StructPlugin/ServicePlugin hooks
+// appropriate for data, the template context DeclareGrouped was just
+// called with. Struct and service generators call DeclareGrouped with the
+// compile.StructSpec/compile.ServiceSpec they're declaring against as
+// data, so this is the one place common to both where those hooks can run
+// right after the built-in declarations for that type have been added.
+func (g *generator) dispatchGroupedPlugins(data interface{}) error {
+	switch spec := data.(type) {
+	case *compile.StructSpec:
+		return g.callStructPlugins(spec)
+	case *compile.ServiceSpec:
+		return g.callServicePlugins(spec)
+	}
+	return nil
 }
 
 func (g *generator) Write(w io.Writer, _ *token.FileSet) error {
-	// TODO constants first, types next, and functions after that
+	if err := g.loadRewrites(); err != nil {
+		return err
+	}
 
-	if _, err := w.Write([]byte(generatedByHeader)); err != nil {
+	var buf bytes.Buffer
+
+	if _, err := buf.Write([]byte(generatedByHeader)); err != nil {
 		return err
 	}
 
-	if _, err := fmt.Fprintf(w, "package %s\n\n", g.PackageName); err != nil {
+	if _, err := fmt.Fprintf(&buf, "package %s\n\n", g.PackageName); err != nil {
 		return err
 	}
 
@@ -478,30 +715,57 @@ func (g *generator) Write(w io.Writer, _ *token.FileSet) error {
 		Tabwidth: 8,
 	}
 
-	if importDecl := g.importDecl(); importDecl != nil {
-		if err := cfg.Fprint(w, g.fset, importDecl); err != nil {
+	ordered := orderedDecls(g.decls)
+	importDecl := g.prunedImportDecl(ordered)
+	if len(g.rewriteTemplates) > 0 {
+		info := g.rewriteTypeInfo(importDecl, ordered)
+		for _, t := range g.rewriteTemplates {
+			t.Apply(ordered, info, g)
+		}
+		// A rewrite may have dropped the last reference to a package
+		// importDecl already carried, or (via the Importer passed to
+		// Apply above) added one it never had; either way the import
+		// list is only accurate once every rewrite has run.
+		importDecl = g.prunedImportDecl(ordered)
+	}
+
+	if importDecl != nil {
+		if err := cfg.Fprint(&buf, g.fset, importDecl); err != nil {
 			return err
 		}
 	}
 
-	if _, err := io.WriteString(w, "\n"); err != nil {
+	if _, err := buf.WriteString("\n"); err != nil {
 		return err
 	}
 
-	for _, decl := range g.decls {
-		if _, err := io.WriteString(w, "\n"); err != nil {
+	for _, decl := range ordered {
+		if _, err := buf.WriteString("\n"); err != nil {
 			return err
 		}
 
-		if err := cfg.Fprint(w, g.fset, decl); err != nil {
+		if err := cfg.Fprint(&buf, g.fset, decl); err != nil {
 			return err
 		}
 
-		if _, err := io.WriteString(w, "\n"); err != nil {
+		if _, err := buf.WriteString("\n"); err != nil {
 			return err
 		}
 	}
 
+	formatted, err := g.format(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not format generated code: %v:\n%s", err, buf.Bytes())
+	}
+
+	if err := g.callPostWritePlugins(formatted); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(formatted); err != nil {
+		return err
+	}
+
 	g.decls = nil
 	g.importer = newImporter(g.Namespace.Child())
 
@@ -511,9 +775,403 @@ func (g *generator) Write(w io.Writer, _ *token.FileSet) error {
 	return nil
 }
 
-// appendDecl appends a new declaration to the generator.
+// rewriteTypeInfo best-effort type-checks the file Write is about to emit
+// (importDecl plus decls) and returns whatever type information go/types
+// managed to record, for rewrite.Template.Apply to use when deciding
+// whether a parameter may safely bind to a given expression. Type errors
+// are expected and ignored: this file is only one of potentially several
+// files in the package being generated, so it may reference sibling
+// declarations go/types cannot see; whatever partial info results is
+// still enough to rule out an unsafe rewrite, and Apply declines to match
+// anywhere info has no answer.
+func (g *generator) rewriteTypeInfo(importDecl *ast.GenDecl, decls []ast.Decl) *types.Info {
+	info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+
+	fileDecls := decls
+	if importDecl != nil {
+		fileDecls = append([]ast.Decl{importDecl}, decls...)
+	}
+	file := &ast.File{Name: ast.NewIdent(g.PackageName), Decls: fileDecls}
+
+	conf := &types.Config{Importer: importer.Default(), Error: func(error) {}}
+	_, _ = conf.Check(g.ImportPath, g.fset, []*ast.File{file}, info)
+	return info
+}
+
+// loadRewrites parses GeneratorOptions.Rewrites into rewrite.Templates the
+// first time it is called, and is a no-op on subsequent calls.
+func (g *generator) loadRewrites() error {
+	if g.rewritesLoaded {
+		return nil
+	}
+
+	for _, path := range g.rewritePaths {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read rewrite template %s: %v", path, err)
+		}
+
+		tmpl, err := rewrite.Parse(path, src)
+		if err != nil {
+			return err
+		}
+		g.rewriteTemplates = append(g.rewriteTemplates, tmpl)
+	}
+
+	g.rewritesLoaded = true
+	return nil
+}
+
+// format runs src through GeneratorOptions.Formatter if one was configured,
+// or go/format.Source otherwise.
+func (g *generator) format(src []byte) ([]byte, error) {
+	if g.formatter != nil {
+		return g.formatter(src)
+	}
+	return format.Source(src)
+}
+
+// prunedImportDecl returns the accumulated import declaration with any
+// spec dropped whose alias is never referenced by decls.
+//
+// Generator.Import is called eagerly by template helpers like
+// typeReference and typeCode, even along a branch of the template that
+// ends up not emitting the reference, which used to produce "imported and
+// not used" errors and forced template authors to guard every call to
+// Import. This trailing pass lets them call it freely.
+func (g *generator) prunedImportDecl(decls []ast.Decl) *ast.GenDecl {
+	importDecl := g.importDecl()
+	if importDecl == nil {
+		return nil
+	}
+	return pruneUnusedImports(importDecl, decls)
+}
+
+// pruneUnusedImports returns a copy of importDecl with any spec dropped
+// whose alias is never referenced by decls, except blank and dot imports,
+// which are always kept (see importAlias and the comment below).
+func pruneUnusedImports(importDecl *ast.GenDecl, decls []ast.Decl) *ast.GenDecl {
+	used := make(map[string]bool)
+	for _, decl := range decls {
+		ast.Inspect(decl, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if id, ok := sel.X.(*ast.Ident); ok {
+				used[id.Name] = true
+			}
+			return true
+		})
+	}
+
+	var kept []ast.Spec
+	for _, spec := range importDecl.Specs {
+		imp := spec.(*ast.ImportSpec)
+		alias := importAlias(imp)
+		// Blank and dot imports are kept unconditionally: they are never
+		// referenced through a *ast.SelectorExpr, so the usage scan above
+		// can never observe them, but recordGenDeclNames explicitly lets
+		// templates emit them (for their side effects) via AddImportSpec.
+		if alias == "_" || alias == "." || used[alias] {
+			kept = append(kept, spec)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+
+	pruned := *importDecl
+	pruned.Specs = kept
+	return &pruned
+}
+
+// importAlias returns the identifier that refers to imp within the
+// generated file.
+func importAlias(imp *ast.ImportSpec) string {
+	if imp.Name != nil {
+		return imp.Name.Name
+	}
+	path := strings.Trim(imp.Path.Value, `"`)
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		path = path[i+1:]
+	}
+	return path
+}
+
+// orderedDecls sorts decls into a fixed, diff-stable order: consts, vars,
+// types, constructors and methods (clustered by owner, see below), free
+// functions, and finally init. Within every other group, the original
+// declaration order is preserved, so templates that rely on related
+// declarations being emitted together (e.g. a type followed by its zero
+// value) are unaffected.
+//
+// Constructors and methods are additionally clustered by the owner tag
+// DeclareGrouped attaches to them: all of one Thrift type's constructors
+// come first, immediately followed by all of that type's methods (sorted
+// by receiver and method name), before moving on to the next owner, in
+// the order owners were first declared. Declarations with no owner (from
+// plain DeclareFromTemplate/EnsureDeclared calls) form their own group,
+// ordered the same way.
+func orderedDecls(decls []declGroup) []ast.Decl {
+	groups := make([][]declGroup, declInit+1)
+	for _, d := range decls {
+		groups[d.kind] = append(groups[d.kind], d)
+	}
+
+	ownerOrder := make([]string, 0)
+	seenOwner := make(map[string]bool)
+	ctorsByOwner := make(map[string][]declGroup)
+	methodsByOwner := make(map[string][]declGroup)
+
+	noteOwner := func(owner string) {
+		if !seenOwner[owner] {
+			seenOwner[owner] = true
+			ownerOrder = append(ownerOrder, owner)
+		}
+	}
+	for _, d := range groups[declConstructor] {
+		noteOwner(d.owner)
+		ctorsByOwner[d.owner] = append(ctorsByOwner[d.owner], d)
+	}
+	for _, d := range groups[declMethod] {
+		noteOwner(d.owner)
+		methodsByOwner[d.owner] = append(methodsByOwner[d.owner], d)
+	}
+	for owner, methods := range methodsByOwner {
+		sort.SliceStable(methods, func(i, j int) bool {
+			di, dj := methods[i].decl.(*ast.FuncDecl), methods[j].decl.(*ast.FuncDecl)
+			ri, rj := methodReceiver(di), methodReceiver(dj)
+			if ri != rj {
+				return ri < rj
+			}
+			return methodName(di) < methodName(dj)
+		})
+		methodsByOwner[owner] = methods
+	}
+
+	out := make([]ast.Decl, 0, len(decls))
+	for _, kind := range []declKind{declConst, declVar, declType} {
+		for _, d := range groups[kind] {
+			out = append(out, d.decl)
+		}
+	}
+	for _, owner := range ownerOrder {
+		for _, d := range ctorsByOwner[owner] {
+			out = append(out, d.decl)
+		}
+		for _, d := range methodsByOwner[owner] {
+			out = append(out, d.decl)
+		}
+	}
+	for _, kind := range []declKind{declFunc, declInit} {
+		for _, d := range groups[kind] {
+			out = append(out, d.decl)
+		}
+	}
+	return out
+}
+
+func (g *generator) WriteWithRemap(w io.Writer, previous []byte) error {
+	var buf bytes.Buffer
+	if err := g.Write(&buf, nil); err != nil {
+		return err
+	}
+	out := buf.Bytes()
+
+	if previous == nil {
+		_, err := w.Write(out)
+		return err
+	}
+
+	if sha256.Sum256(previous) == sha256.Sum256(out) {
+		// Nothing changed; leave the file on disk untouched.
+		return nil
+	}
+
+	merged, err := spliceAnnotations(previous, out)
+	if err != nil {
+		// Remapping is a best-effort convenience for minimizing diffs; a
+		// failure to remap should not fail generation.
+		merged = out
+	}
+
+	_, err = w.Write(merged)
+	return err
+}
+
+// preservedPrefixes lists the hand-edited annotations that thriftrw never
+// emits itself and which spliceAnnotations will carry over from a previous
+// generation of the file rather than silently drop.
+var preservedPrefixes = []string{
+	"//go:generate",
+	"//go:build",
+	"// +build",
+	"// keep",
+}
+
+func isPreservedAnnotation(text string) bool {
+	trimmed := strings.TrimSpace(text)
+	for _, prefix := range preservedPrefixes {
+		if strings.HasPrefix(trimmed, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// spliceAnnotations realigns old against new with remap.Compute and
+// reinserts any preserved annotation found in a gap of old that did not
+// survive into new, at the position implied by the surrounding spans.
+func spliceAnnotations(old, new []byte) ([]byte, error) {
+	spans, err := remap.Compute(old, new)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	oldPos, newPos := 0, 0
+	for _, sp := range spans {
+		if gap := old[oldPos:sp.OldLo]; isPreservedAnnotation(string(gap)) {
+			out.Write(gap)
+		}
+		out.Write(new[newPos:sp.NewHi])
+		oldPos, newPos = sp.OldHi, sp.NewHi
+	}
+	if gap := old[oldPos:]; isPreservedAnnotation(string(gap)) {
+		out.Write(gap)
+	}
+	out.Write(new[newPos:])
+
+	return out.Bytes(), nil
+}
+
+// declKind classifies a top-level declaration for the purposes of
+// ordering output in Write: constants first, types next, and functions
+// after that, with related declarations grouped together.
+type declKind int
+
+const (
+	declConst declKind = iota
+	declVar
+	declType
+	declConstructor
+	declMethod
+	declFunc
+	declInit
+)
+
+// declGroup tags a declaration with its kind and, when known, the name of
+// the Thrift type that owns it, so that Write can emit a diff-stable file:
+// imports, then consts, vars, types, constructors, methods (grouped by
+// receiver and sorted by name), free functions, and finally init.
+type declGroup struct {
+	decl  ast.Decl
+	kind  declKind
+	owner string
+}
+
+// classifyDecl infers a declKind from the shape of decl. Constructors are
+// recognized by the "New" prefix on a receiver-less function name, matching
+// the convention the built-in templates already follow.
+func classifyDecl(decl ast.Decl) declKind {
+	switch d := decl.(type) {
+	case *ast.GenDecl:
+		switch d.Tok {
+		case token.CONST:
+			return declConst
+		case token.VAR:
+			return declVar
+		case token.TYPE:
+			return declType
+		}
+	case *ast.FuncDecl:
+		switch {
+		case d.Recv != nil:
+			return declMethod
+		case d.Name.Name == "init":
+			return declInit
+		case strings.HasPrefix(d.Name.Name, "New"):
+			return declConstructor
+		}
+	}
+	return declFunc
+}
+
+// methodReceiver returns the receiver type name of d, or "" if d is not a
+// method.
+func methodReceiver(d *ast.FuncDecl) string {
+	if d.Recv == nil || len(d.Recv.List) == 0 {
+		return ""
+	}
+	return types.ExprString(d.Recv.List[0].Type)
+}
+
+// methodName returns the name of the function d declares.
+func methodName(d *ast.FuncDecl) string {
+	return d.Name.Name
+}
+
+// appendDecl appends a new declaration to the generator, inferring its
+// group from its shape.
 func (g *generator) appendDecl(decl ast.Decl) {
-	g.decls = append(g.decls, decl)
+	g.appendDeclGrouped("", decl)
+}
+
+// appendDeclGrouped is like appendDecl, but additionally tags decl with the
+// Thrift type that owns it.
+func (g *generator) appendDeclGrouped(owner string, decl ast.Decl) {
+	g.decls = append(g.decls, declGroup{decl: decl, kind: classifyDecl(decl), owner: owner})
+}
+
+// callStructPlugins invokes GenerateStruct for every plugin that implements
+// StructPlugin, in the order the plugins were configured. It is called by
+// DeclareGrouped once the built-in declarations for s have been declared.
+func (g *generator) callStructPlugins(s *compile.StructSpec) error {
+	for _, p := range g.plugins {
+		sp, ok := p.(StructPlugin)
+		if !ok {
+			continue
+		}
+		if err := sp.GenerateStruct(g, s); err != nil {
+			return fmt.Errorf("plugin %q failed to generate struct %q: %v", p.Name(), s.Name, err)
+		}
+	}
+	return nil
+}
+
+// callPostWritePlugins invokes PostWrite for every plugin that implements
+// PostWritePlugin, passing it the single file produced by the Write call
+// that just finished formatting contents.
+func (g *generator) callPostWritePlugins(contents []byte) error {
+	file := GeneratedFile{Name: g.PackageName + ".go", Contents: contents}
+	for _, p := range g.plugins {
+		pwp, ok := p.(PostWritePlugin)
+		if !ok {
+			continue
+		}
+		if err := pwp.PostWrite(g.ImportPath, []GeneratedFile{file}); err != nil {
+			return fmt.Errorf("plugin %q failed in PostWrite: %v", p.Name(), err)
+		}
+	}
+	return nil
+}
+
+// callServicePlugins invokes GenerateService for every plugin that
+// implements ServicePlugin, in the order the plugins were configured. It is
+// called by DeclareGrouped once the built-in declarations for s have been
+// declared.
+func (g *generator) callServicePlugins(s *compile.ServiceSpec) error {
+	for _, p := range g.plugins {
+		sp, ok := p.(ServicePlugin)
+		if !ok {
+			continue
+		}
+		if err := sp.GenerateService(g, s); err != nil {
+			return fmt.Errorf("plugin %q failed to generate service %q: %v", p.Name(), s.Name, err)
+		}
+	}
+	return nil
 }
 
 func formatDoc(s string) string {
@@ -0,0 +1,268 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gen
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+
+	"go.uber.org/thriftrw/compile"
+)
+
+// parseDecls parses src as the body of a file (src should not include the
+// "package" clause) and returns its top-level declarations.
+func parseDecls(t *testing.T, src string) []ast.Decl {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "src.go", "package p\n\n"+src, 0)
+	if err != nil {
+		t.Fatalf("could not parse source: %v", err)
+	}
+	return f.Decls
+}
+
+func TestPruneUnusedImportsKeepsUsedAndSideEffectImports(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "imports.go", `package p
+
+import (
+	"fmt"
+	"strings"
+	_ "net/http/pprof"
+	. "math"
+)
+`, 0)
+	if err != nil {
+		t.Fatalf("could not parse source: %v", err)
+	}
+	importDecl := f.Decls[0].(*ast.GenDecl)
+
+	decls := parseDecls(t, `func F() string { return fmt.Sprintf("%d", 1) }`)
+
+	pruned := pruneUnusedImports(importDecl, decls)
+	if pruned == nil {
+		t.Fatal("expected a non-nil import declaration")
+	}
+
+	var kept []string
+	for _, spec := range pruned.Specs {
+		kept = append(kept, importAlias(spec.(*ast.ImportSpec)))
+	}
+
+	want := map[string]bool{"fmt": true, "_": true, ".": true}
+	if len(kept) != len(want) {
+		t.Fatalf("expected %d imports to survive pruning, got %v", len(want), kept)
+	}
+	for _, alias := range kept {
+		if !want[alias] {
+			t.Fatalf("did not expect %q to survive pruning, got %v", alias, kept)
+		}
+	}
+	for alias := range want {
+		found := false
+		for _, k := range kept {
+			if k == alias {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected %q to survive pruning, got %v", alias, kept)
+		}
+	}
+}
+
+func TestPruneUnusedImportsAllUnused(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "imports.go", `package p
+
+import "strings"
+`, 0)
+	if err != nil {
+		t.Fatalf("could not parse source: %v", err)
+	}
+	importDecl := f.Decls[0].(*ast.GenDecl)
+
+	decls := parseDecls(t, `func F() int { return 1 }`)
+
+	if pruned := pruneUnusedImports(importDecl, decls); pruned != nil {
+		t.Fatalf("expected a nil import declaration once every import is unused, got %+v", pruned)
+	}
+}
+
+// declName returns an identifying name for d: the first name in a const/
+// var/type GenDecl, or a FuncDecl's name, prefixed with its receiver type
+// for methods.
+func declName(d ast.Decl) string {
+	switch x := d.(type) {
+	case *ast.GenDecl:
+		switch spec := x.Specs[0].(type) {
+		case *ast.ValueSpec:
+			return spec.Names[0].Name
+		case *ast.TypeSpec:
+			return spec.Name.Name
+		}
+	case *ast.FuncDecl:
+		if x.Recv != nil {
+			return methodReceiver(x) + "." + x.Name.Name
+		}
+		return x.Name.Name
+	}
+	return "?"
+}
+
+func TestOrderedDeclsClustersEachOwnersConstructorsAndMethods(t *testing.T) {
+	decls := parseDecls(t, `
+const C = 1
+
+func NewFoo() *Foo { return nil }
+func (f *Foo) Zebra() {}
+func (f *Foo) Apple() {}
+func NewBar() *Bar { return nil }
+func (b *Bar) Method() {}
+func Helper() {}
+func init() {}
+`)
+
+	// Owners, by source order: const has none, then Foo, Foo, Foo, Bar,
+	// Bar, Helper/init have none.
+	owners := []string{"", "Foo", "Foo", "Foo", "Bar", "Bar", "", ""}
+
+	groups := make([]declGroup, len(decls))
+	for i, d := range decls {
+		groups[i] = declGroup{decl: d, kind: classifyDecl(d), owner: owners[i]}
+	}
+
+	ordered := orderedDecls(groups)
+
+	var got []string
+	for _, d := range ordered {
+		got = append(got, declName(d))
+	}
+
+	// Foo's constructor and both its methods (sorted by name within the
+	// owner) come before Bar's, which in turn come before the ungrouped
+	// free function and init.
+	want := []string{"C", "NewFoo", "*Foo.Apple", "*Foo.Zebra", "NewBar", "*Bar.Method", "Helper", "init"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestCheckReservedName(t *testing.T) {
+	g := &generator{extraReserved: map[string]struct{}{"myReserved": {}}}
+
+	for _, name := range []string{"err", "w", "v", "sr", "lh", "rhs", "x", "myReserved"} {
+		if err := g.checkReservedName(name); err == nil {
+			t.Errorf("expected %q to be rejected as a reserved name", name)
+		}
+	}
+
+	for _, name := range []string{"foo", "Name", "myField"} {
+		if err := g.checkReservedName(name); err != nil {
+			t.Errorf("did not expect %q to be rejected as a reserved name: %v", name, err)
+		}
+	}
+}
+
+// TestDeclareRejectsReservedNames exercises the integration point
+// TestCheckReservedName does not: g.declare parsing a top-level const,
+// var, type, or import alias and rejecting it, through
+// recordGenDeclNames, because its name collides with a reserved template
+// identifier.
+func TestDeclareRejectsReservedNames(t *testing.T) {
+	g := NewGenerator(&GeneratorOptions{PackageName: "p", ImportPath: "example.com/p"}).(*generator)
+
+	reserved := []string{
+		`const err = 1`,
+		`var w int`,
+		`type sr struct{}`,
+		`import rhs "fmt"`,
+	}
+	for _, src := range reserved {
+		if err := g.declare(false, "", src, nil); err == nil {
+			t.Errorf("expected declaring %q to be rejected as a reserved name", src)
+		}
+	}
+
+	if err := g.declare(false, "", `const ok = 1`, nil); err != nil {
+		t.Errorf("did not expect declaring a non-reserved const to fail: %v", err)
+	}
+}
+
+// fakePlugin records whether its struct/service hooks were invoked, and by
+// which generator and spec.
+type fakePlugin struct {
+	structCalls  []*compile.StructSpec
+	serviceCalls []*compile.ServiceSpec
+}
+
+func (p *fakePlugin) Name() string { return "fake" }
+
+func (p *fakePlugin) GenerateStruct(g Generator, s *compile.StructSpec) error {
+	p.structCalls = append(p.structCalls, s)
+	return nil
+}
+
+func (p *fakePlugin) GenerateService(g Generator, s *compile.ServiceSpec) error {
+	p.serviceCalls = append(p.serviceCalls, s)
+	return nil
+}
+
+func TestDispatchGroupedPluginsRoutesByDataType(t *testing.T) {
+	p := &fakePlugin{}
+	g := &generator{plugins: []Plugin{p}}
+
+	structSpec := &compile.StructSpec{Name: "Foo"}
+	if err := g.dispatchGroupedPlugins(structSpec); err != nil {
+		t.Fatalf("unexpected error dispatching a struct spec: %v", err)
+	}
+	if len(p.structCalls) != 1 || p.structCalls[0] != structSpec {
+		t.Fatalf("expected GenerateStruct to be called once with %v, got %v", structSpec, p.structCalls)
+	}
+	if len(p.serviceCalls) != 0 {
+		t.Fatalf("did not expect GenerateService to be called for a struct spec, got %v", p.serviceCalls)
+	}
+
+	serviceSpec := &compile.ServiceSpec{Name: "Bar"}
+	if err := g.dispatchGroupedPlugins(serviceSpec); err != nil {
+		t.Fatalf("unexpected error dispatching a service spec: %v", err)
+	}
+	if len(p.serviceCalls) != 1 || p.serviceCalls[0] != serviceSpec {
+		t.Fatalf("expected GenerateService to be called once with %v, got %v", serviceSpec, p.serviceCalls)
+	}
+
+	// Data that isn't a struct or service spec (e.g. a plain
+	// DeclareFromTemplate/EnsureDeclared call, which passes owner="" and
+	// whatever the template's own context is) must not dispatch anything.
+	if err := g.dispatchGroupedPlugins(struct{}{}); err != nil {
+		t.Fatalf("unexpected error dispatching unrecognized data: %v", err)
+	}
+	if len(p.structCalls) != 1 || len(p.serviceCalls) != 1 {
+		t.Fatalf("did not expect unrecognized data to trigger any plugin hook, got struct=%v service=%v", p.structCalls, p.serviceCalls)
+	}
+}
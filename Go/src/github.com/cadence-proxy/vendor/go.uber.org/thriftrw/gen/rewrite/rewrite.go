@@ -0,0 +1,546 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package rewrite implements example-based rewrites over generated code,
+// in the style of golang.org/x/tools' refactor/eg: a template file pairs a
+// "before" function with an "after" function, and every expression shaped
+// like a call to before found in the generator's declarations is rewritten
+// to the equivalent call to after, with before's parameters bound to
+// whatever matched in their position.
+//
+// A template file looks like:
+//
+//	package rewrite
+//
+//	import "go.uber.org/thriftrw/wire"
+//
+//	func before(x []byte) wire.Value { return wire.NewValueBinary(x) }
+//	func after(x []byte) wire.Value  { return wire.NewValueBinary(append([]byte(nil), x...)) }
+//
+// which rewrites every "wire.NewValueBinary(E)" found in generated code to
+// "wire.NewValueBinary(append([]byte(nil), E...))", for any expression E.
+//
+// before and after must declare identical signatures, and a parameter may
+// only bind to a call-site expression whose static type, as determined by
+// go/types, is identical to the parameter's declared type: matching falls
+// back to AST shape only to locate candidate call sites, never to decide
+// whether a binding is safe. If the type of a candidate expression cannot
+// be determined -- for example because the file being rewritten does not
+// type-check in isolation -- Apply declines the match instead of guessing,
+// since a false rewrite is far worse than a missed one.
+//
+// after may reference packages before never does -- for example, a
+// tracing wrapper around a ToWire/FromWire call -- and is not limited to
+// packages the generated file already imports. Apply imports whatever
+// after needs into the file being generated on the caller's behalf, under
+// whatever alias that file already uses or picks for the package.
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// Importer is implemented by the code that Apply rewrites declarations
+// for. Import ensures that path has been imported into the file being
+// generated and returns the name that should be used to refer to it
+// there, which may differ from the alias the template file itself used
+// for that import. gen.Generator already implements this.
+type Importer interface {
+	Import(path string) string
+}
+
+// Template is a single before/after rewrite rule parsed from a template
+// file.
+type Template struct {
+	params     map[string]bool
+	paramTypes map[string]types.Type
+	before     ast.Expr
+	after      ast.Expr
+
+	// afterImports maps every package alias the template file declares
+	// that after's expression actually references (other than a
+	// before-parameter) to its import path. Apply uses this to import
+	// those packages into the file being generated -- under whatever
+	// alias that file already uses or picks for them -- even when after
+	// references a package before never did, such as a tracing wrapper
+	// around a ToWire/FromWire call.
+	afterImports map[string]string
+}
+
+// Parse reads a template file containing top-level "before" and "after"
+// functions and returns the Template that rewrites one into the other.
+func Parse(filename string, src []byte) (*Template, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse rewrite template %s: %v", filename, err)
+	}
+
+	var before, after *ast.FuncDecl
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil {
+			continue
+		}
+		switch fn.Name.Name {
+		case "before":
+			before = fn
+		case "after":
+			after = fn
+		}
+	}
+	if before == nil || after == nil {
+		return nil, fmt.Errorf(
+			"rewrite template %s must define both a %q and an %q function",
+			filename, "before", "after")
+	}
+	if err := sameSignature(before.Type, after.Type); err != nil {
+		return nil, fmt.Errorf("%s: before and after must have identical signatures: %v", filename, err)
+	}
+
+	beforeExpr, err := singleReturnExpr(before)
+	if err != nil {
+		return nil, fmt.Errorf("%s: before: %v", filename, err)
+	}
+	afterExpr, err := singleReturnExpr(after)
+	if err != nil {
+		return nil, fmt.Errorf("%s: after: %v", filename, err)
+	}
+
+	params := make(map[string]bool)
+	for _, field := range before.Type.Params.List {
+		for _, name := range field.Names {
+			params[name.Name] = true
+		}
+	}
+
+	paramTypes, err := beforeParamTypes(fset, f, before)
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not type-check rewrite template: %v", filename, err)
+	}
+
+	afterImports := importsReferencedBy(afterExpr, params, fileImportAliases(f))
+
+	return &Template{
+		params:       params,
+		paramTypes:   paramTypes,
+		before:       beforeExpr,
+		after:        afterExpr,
+		afterImports: afterImports,
+	}, nil
+}
+
+// fileImportAliases maps the alias each import in f is referred to by
+// within f -- its explicit name, or the last path component otherwise --
+// to its import path.
+func fileImportAliases(f *ast.File) map[string]string {
+	aliases := make(map[string]string, len(f.Imports))
+	for _, imp := range f.Imports {
+		path := strings.Trim(imp.Path.Value, `"`)
+		alias := path
+		if imp.Name != nil {
+			alias = imp.Name.Name
+		} else if i := strings.LastIndexByte(path, '/'); i >= 0 {
+			alias = path[i+1:]
+		}
+		aliases[alias] = path
+	}
+	return aliases
+}
+
+// importsReferencedBy returns the subset of aliases that e references
+// through a bare *ast.Ident, excluding the template's own before-
+// parameters (params), keyed the same way aliases is.
+func importsReferencedBy(e ast.Expr, params map[string]bool, aliases map[string]string) map[string]string {
+	referenced := make(map[string]string)
+	ast.Inspect(e, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || params[id.Name] {
+			return true
+		}
+		if path, ok := aliases[id.Name]; ok {
+			referenced[id.Name] = path
+		}
+		return true
+	})
+	return referenced
+}
+
+// beforeParamTypes type-checks f and returns the declared type of each of
+// before's parameters, keyed by parameter name. A template file is a
+// complete, self-contained package (its before/after functions import
+// whatever they reference directly), so it type-checks on its own without
+// needing the context of the generated file it will eventually be applied
+// to.
+func beforeParamTypes(fset *token.FileSet, f *ast.File, before *ast.FuncDecl) (map[string]types.Type, error) {
+	info := &types.Info{Defs: make(map[*ast.Ident]types.Object)}
+	conf := &types.Config{Importer: importer.Default()}
+	if _, err := conf.Check(f.Name.Name, fset, []*ast.File{f}, info); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]types.Type)
+	for _, field := range before.Type.Params.List {
+		for _, name := range field.Names {
+			obj := info.Defs[name]
+			if obj == nil {
+				return nil, fmt.Errorf("could not resolve the type of parameter %q", name.Name)
+			}
+			result[name.Name] = obj.Type()
+		}
+	}
+	return result, nil
+}
+
+// singleReturnExpr extracts E from a function body of the form
+// "return E", the only shape a template's before/after functions may take.
+func singleReturnExpr(fn *ast.FuncDecl) (ast.Expr, error) {
+	if fn.Body == nil || len(fn.Body.List) != 1 {
+		return nil, fmt.Errorf("must consist of a single \"return <expr>\" statement")
+	}
+	ret, ok := fn.Body.List[0].(*ast.ReturnStmt)
+	if !ok || len(ret.Results) != 1 {
+		return nil, fmt.Errorf("must consist of a single \"return <expr>\" statement")
+	}
+	return ret.Results[0], nil
+}
+
+// sameSignature reports whether a and b declare the same parameter and
+// result types, compared textually since no type-checker is available.
+func sameSignature(a, b *ast.FuncType) error {
+	if exprString(a.Params) != exprString(b.Params) {
+		return fmt.Errorf("parameter lists differ")
+	}
+	aResults, bResults := "", ""
+	if a.Results != nil {
+		aResults = exprString(a.Results)
+	}
+	if b.Results != nil {
+		bResults = exprString(b.Results)
+	}
+	if aResults != bResults {
+		return fmt.Errorf("result lists differ")
+	}
+	return nil
+}
+
+// Apply rewrites every match of the template's before expression found in
+// decls to the template's after expression, with before's parameters bound
+// to whatever matched in their position in the original code. info
+// supplies the static type of every expression in decls, as produced by
+// go/types against decls in the context of the file being generated; a
+// parameter only binds to an expression whose type in info is identical
+// to the parameter's declared type. imp is called to import, into the
+// file being generated, every package after references that isn't simply
+// copied over from a bound before-parameter -- this is what lets an after
+// expression introduce a package before never used, such as a tracing
+// wrapper around a ToWire/FromWire call. Matched declarations are
+// rewritten in place; Apply returns the number of rewrites applied.
+func (t *Template) Apply(decls []ast.Decl, info *types.Info, imp Importer) int {
+	a := &applier{t: t, info: info, imp: imp}
+	for _, decl := range decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			a.block(fn.Body)
+		}
+	}
+	return a.count
+}
+
+// applier walks the statements and expressions of a declaration, looking
+// for matches of a Template's before expression and rewriting them to
+// after in place. It replaces golang.org/x/tools/go/ast/astutil's
+// generic, type-checker-agnostic Apply/Cursor walk -- which this package
+// cannot depend on -- with one narrowly scoped to the statement and
+// expression shapes the built-in templates actually emit.
+type applier struct {
+	t     *Template
+	info  *types.Info
+	imp   Importer
+	count int
+}
+
+// expr rewrites e in place if it matches t.before, and otherwise
+// recurses into its subexpressions looking for nested matches. It
+// returns the (possibly replaced) expression.
+func (a *applier) expr(e ast.Expr) ast.Expr {
+	if e == nil {
+		return nil
+	}
+
+	bindings := make(map[string]ast.Expr)
+	if a.t.match(a.t.before, e, bindings, a.info) {
+		a.count++
+		return a.substitute(a.t.after, bindings)
+	}
+
+	switch n := e.(type) {
+	case *ast.CallExpr:
+		n.Fun = a.expr(n.Fun)
+		for i, arg := range n.Args {
+			n.Args[i] = a.expr(arg)
+		}
+	case *ast.BinaryExpr:
+		n.X = a.expr(n.X)
+		n.Y = a.expr(n.Y)
+	case *ast.UnaryExpr:
+		n.X = a.expr(n.X)
+	case *ast.ParenExpr:
+		n.X = a.expr(n.X)
+	case *ast.StarExpr:
+		n.X = a.expr(n.X)
+	case *ast.SelectorExpr:
+		n.X = a.expr(n.X)
+	case *ast.IndexExpr:
+		n.X = a.expr(n.X)
+		n.Index = a.expr(n.Index)
+	case *ast.SliceExpr:
+		n.X = a.expr(n.X)
+		n.Low = a.expr(n.Low)
+		n.High = a.expr(n.High)
+		n.Max = a.expr(n.Max)
+	case *ast.TypeAssertExpr:
+		n.X = a.expr(n.X)
+	case *ast.KeyValueExpr:
+		n.Key = a.expr(n.Key)
+		n.Value = a.expr(n.Value)
+	case *ast.CompositeLit:
+		for i, el := range n.Elts {
+			n.Elts[i] = a.expr(el)
+		}
+	}
+	return e
+}
+
+func (a *applier) exprs(list []ast.Expr) {
+	for i, e := range list {
+		list[i] = a.expr(e)
+	}
+}
+
+func (a *applier) stmt(s ast.Stmt) {
+	switch n := s.(type) {
+	case nil:
+	case *ast.ExprStmt:
+		n.X = a.expr(n.X)
+	case *ast.ReturnStmt:
+		a.exprs(n.Results)
+	case *ast.AssignStmt:
+		a.exprs(n.Lhs)
+		a.exprs(n.Rhs)
+	case *ast.IncDecStmt:
+		n.X = a.expr(n.X)
+	case *ast.SendStmt:
+		n.Chan = a.expr(n.Chan)
+		n.Value = a.expr(n.Value)
+	case *ast.DeferStmt:
+		if call, ok := a.expr(n.Call).(*ast.CallExpr); ok {
+			n.Call = call
+		}
+	case *ast.GoStmt:
+		if call, ok := a.expr(n.Call).(*ast.CallExpr); ok {
+			n.Call = call
+		}
+	case *ast.DeclStmt:
+		if gd, ok := n.Decl.(*ast.GenDecl); ok {
+			a.genDecl(gd)
+		}
+	case *ast.BlockStmt:
+		a.block(n)
+	case *ast.IfStmt:
+		a.stmt(n.Init)
+		n.Cond = a.expr(n.Cond)
+		a.block(n.Body)
+		a.stmt(n.Else)
+	case *ast.ForStmt:
+		a.stmt(n.Init)
+		n.Cond = a.expr(n.Cond)
+		a.stmt(n.Post)
+		a.block(n.Body)
+	case *ast.RangeStmt:
+		n.X = a.expr(n.X)
+		a.block(n.Body)
+	case *ast.SwitchStmt:
+		a.stmt(n.Init)
+		n.Tag = a.expr(n.Tag)
+		a.block(n.Body)
+	case *ast.TypeSwitchStmt:
+		a.stmt(n.Init)
+		a.stmt(n.Assign)
+		a.block(n.Body)
+	case *ast.CaseClause:
+		a.exprs(n.List)
+		for _, s := range n.Body {
+			a.stmt(s)
+		}
+	case *ast.LabeledStmt:
+		a.stmt(n.Stmt)
+	}
+}
+
+func (a *applier) block(b *ast.BlockStmt) {
+	if b == nil {
+		return
+	}
+	for _, s := range b.List {
+		a.stmt(s)
+	}
+}
+
+func (a *applier) genDecl(d *ast.GenDecl) {
+	for _, spec := range d.Specs {
+		if vs, ok := spec.(*ast.ValueSpec); ok {
+			a.exprs(vs.Values)
+		}
+	}
+}
+
+// match reports whether node has the same shape as pattern, binding
+// pattern's before-parameters to whatever subexpression occupies their
+// position. A parameter bound more than once must match identically
+// (textually) every time it recurs, and every binding must have a static
+// type, recorded in info, identical to the parameter's declared type;
+// info is best-effort and may not cover every expression, and an
+// expression Apply cannot determine the type of never matches a
+// parameter.
+func (t *Template) match(pattern, node ast.Expr, bindings map[string]ast.Expr, info *types.Info) bool {
+	if id, ok := pattern.(*ast.Ident); ok && t.params[id.Name] {
+		if bound, ok := bindings[id.Name]; ok {
+			return exprString(bound) == exprString(node)
+		}
+
+		if info == nil {
+			return false
+		}
+		want := t.paramTypes[id.Name]
+		got := info.TypeOf(node)
+		if want == nil || got == nil || !types.Identical(got, want) {
+			return false
+		}
+
+		bindings[id.Name] = node
+		return true
+	}
+
+	switch p := pattern.(type) {
+	case *ast.Ident:
+		n, ok := node.(*ast.Ident)
+		return ok && n.Name == p.Name
+	case *ast.BasicLit:
+		n, ok := node.(*ast.BasicLit)
+		return ok && n.Kind == p.Kind && n.Value == p.Value
+	case *ast.SelectorExpr:
+		n, ok := node.(*ast.SelectorExpr)
+		return ok && p.Sel.Name == n.Sel.Name && t.match(p.X, n.X, bindings, info)
+	case *ast.CallExpr:
+		n, ok := node.(*ast.CallExpr)
+		if !ok || len(p.Args) != len(n.Args) || !t.match(p.Fun, n.Fun, bindings, info) {
+			return false
+		}
+		for i := range p.Args {
+			if !t.match(p.Args[i], n.Args[i], bindings, info) {
+				return false
+			}
+		}
+		return true
+	case *ast.ParenExpr:
+		n, ok := node.(*ast.ParenExpr)
+		return ok && t.match(p.X, n.X, bindings, info)
+	case *ast.StarExpr:
+		n, ok := node.(*ast.StarExpr)
+		return ok && t.match(p.X, n.X, bindings, info)
+	case *ast.UnaryExpr:
+		n, ok := node.(*ast.UnaryExpr)
+		return ok && n.Op == p.Op && t.match(p.X, n.X, bindings, info)
+	case *ast.BinaryExpr:
+		n, ok := node.(*ast.BinaryExpr)
+		return ok && n.Op == p.Op && t.match(p.X, n.X, bindings, info) && t.match(p.Y, n.Y, bindings, info)
+	case *ast.IndexExpr:
+		n, ok := node.(*ast.IndexExpr)
+		return ok && t.match(p.X, n.X, bindings, info) && t.match(p.Index, n.Index, bindings, info)
+	case *ast.ArrayType:
+		n, ok := node.(*ast.ArrayType)
+		return ok && (p.Len == nil) == (n.Len == nil) && exprString(p.Elt) == exprString(n.Elt)
+	default:
+		// Anything more exotic (composite literals, type assertions, ...)
+		// is compared for exact textual equality instead of structurally.
+		return exprString(pattern) == exprString(node)
+	}
+}
+
+// substitute builds a fresh copy of pattern with every before-parameter
+// replaced by its binding, and every free identifier that names one of
+// the template's afterImports replaced by the name a.imp assigns that
+// import in the file being generated. A fresh copy is required because
+// the same template after-expression may be spliced into the output more
+// than once, and AST nodes must not be shared between positions in a
+// tree that go/printer will walk independently.
+func (a *applier) substitute(pattern ast.Expr, bindings map[string]ast.Expr) ast.Expr {
+	if id, ok := pattern.(*ast.Ident); ok {
+		if bound, ok := bindings[id.Name]; ok {
+			return bound
+		}
+		if path, ok := a.t.afterImports[id.Name]; ok && a.imp != nil {
+			return ast.NewIdent(a.imp.Import(path))
+		}
+		cp := *id
+		return &cp
+	}
+
+	switch p := pattern.(type) {
+	case *ast.BasicLit:
+		cp := *p
+		return &cp
+	case *ast.SelectorExpr:
+		return &ast.SelectorExpr{X: a.substitute(p.X, bindings), Sel: p.Sel}
+	case *ast.CallExpr:
+		args := make([]ast.Expr, len(p.Args))
+		for i, arg := range p.Args {
+			args[i] = a.substitute(arg, bindings)
+		}
+		return &ast.CallExpr{Fun: a.substitute(p.Fun, bindings), Args: args, Ellipsis: p.Ellipsis}
+	case *ast.ParenExpr:
+		return &ast.ParenExpr{X: a.substitute(p.X, bindings)}
+	case *ast.StarExpr:
+		return &ast.StarExpr{X: a.substitute(p.X, bindings)}
+	case *ast.UnaryExpr:
+		return &ast.UnaryExpr{Op: p.Op, X: a.substitute(p.X, bindings)}
+	case *ast.BinaryExpr:
+		return &ast.BinaryExpr{Op: p.Op, X: a.substitute(p.X, bindings), Y: a.substitute(p.Y, bindings)}
+	case *ast.IndexExpr:
+		return &ast.IndexExpr{X: a.substitute(p.X, bindings), Index: a.substitute(p.Index, bindings)}
+	default:
+		return pattern
+	}
+}
+
+// exprString renders e as Go source, for structural/textual comparisons.
+func exprString(n ast.Node) string {
+	var buf bytes.Buffer
+	_ = printer.Fprint(&buf, token.NewFileSet(), n)
+	return buf.String()
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rewrite
+
+import (
+	"bytes"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"reflect"
+	"testing"
+)
+
+const lenCapTemplate = `
+package rewrite
+
+func before(x []byte) int { return len(x) }
+func after(x []byte) int  { return cap(x) }
+`
+
+// typeCheck parses and type-checks src (a single, self-contained file with
+// no imports) and returns its declarations together with the resulting
+// type info, mirroring what generator.rewriteTypeInfo does for a file
+// being generated.
+func typeCheck(t *testing.T, src string) ([]ast.Decl, *types.Info) {
+	t.Helper()
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "src.go", src, 0)
+	if err != nil {
+		t.Fatalf("could not parse source: %v", err)
+	}
+
+	info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+	conf := &types.Config{Importer: importer.Default()}
+	if _, err := conf.Check("p", fset, []*ast.File{f}, info); err != nil {
+		t.Fatalf("could not type-check source: %v", err)
+	}
+	return f.Decls, info
+}
+
+func render(t *testing.T, decls []ast.Decl) string {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, d := range decls {
+		if err := printer.Fprint(&buf, token.NewFileSet(), d); err != nil {
+			t.Fatalf("could not render declaration: %v", err)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+func TestApplyRewritesMatchingType(t *testing.T) {
+	tmpl, err := Parse("lencap.go", []byte(lenCapTemplate))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decls, info := typeCheck(t, `
+package p
+
+func F(b []byte) int {
+	return len(b)
+}
+`)
+
+	count := tmpl.Apply(decls, info, nil)
+	if count != 1 {
+		t.Fatalf("expected exactly one rewrite, got %d", count)
+	}
+	if got, want := render(t, decls), "cap(b)"; !bytes.Contains([]byte(got), []byte(want)) {
+		t.Fatalf("expected %q to appear in rewritten output, got:\n%s", want, got)
+	}
+}
+
+// TestApplyDeclinesMismatchedType is a regression test for a rule like
+// before(x []byte) int { return len(x) } incorrectly rewriting
+// len(other(b)) to cap(other(b)) even though other's return type has
+// nothing to do with []byte.
+func TestApplyDeclinesMismatchedType(t *testing.T) {
+	tmpl, err := Parse("lencap.go", []byte(lenCapTemplate))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decls, info := typeCheck(t, `
+package p
+
+func other(b []byte) string { return string(b) }
+
+func F(b []byte) int {
+	return len(other(b))
+}
+`)
+
+	count := tmpl.Apply(decls, info, nil)
+	if count != 0 {
+		t.Fatalf("expected no rewrite when the bound expression's type does not match the parameter's, got %d", count)
+	}
+	if got, unwanted := render(t, decls), "cap("; bytes.Contains([]byte(got), []byte(unwanted)) {
+		t.Fatalf("expected len(...) to be left untouched, got:\n%s", got)
+	}
+}
+
+func TestApplyDeclinesWithoutTypeInfo(t *testing.T) {
+	tmpl, err := Parse("lencap.go", []byte(lenCapTemplate))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decls, _ := typeCheck(t, `
+package p
+
+func F(b []byte) int {
+	return len(b)
+}
+`)
+
+	if count := tmpl.Apply(decls, nil, nil); count != 0 {
+		t.Fatalf("expected no rewrite without type information, got %d", count)
+	}
+}
+
+// runeCountTemplate stands in for a rule like a tracing wrapper around
+// ToWire/FromWire: after references a package (unicode/utf8) that before
+// never does, and that the file being generated may have no other reason
+// to import.
+const runeCountTemplate = `
+package rewrite
+
+import "unicode/utf8"
+
+func before(x []byte) int { return len(x) }
+func after(x []byte) int  { return utf8.RuneCount(x) }
+`
+
+// fakeImporter records every path it is asked to import and returns a
+// fixed alias for it, mimicking the part of gen.Generator's behavior that
+// Apply depends on.
+type fakeImporter struct {
+	alias    string
+	imported []string
+}
+
+func (f *fakeImporter) Import(path string) string {
+	f.imported = append(f.imported, path)
+	return f.alias
+}
+
+func TestApplyImportsPackageIntroducedByAfter(t *testing.T) {
+	tmpl, err := Parse("runecount.go", []byte(runeCountTemplate))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decls, info := typeCheck(t, `
+package p
+
+func F(b []byte) int {
+	return len(b)
+}
+`)
+
+	imp := &fakeImporter{alias: "utf8"}
+	count := tmpl.Apply(decls, info, imp)
+	if count != 1 {
+		t.Fatalf("expected exactly one rewrite, got %d", count)
+	}
+	if got, want := render(t, decls), `utf8.RuneCount(b)`; !bytes.Contains([]byte(got), []byte(want)) {
+		t.Fatalf("expected %q to appear in rewritten output, got:\n%s", want, got)
+	}
+	if want := []string{"unicode/utf8"}; !reflect.DeepEqual(imp.imported, want) {
+		t.Fatalf("expected Import to be called with %v, got %v", want, imp.imported)
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package remap computes a mapping between byte spans of a previous
+// rendering of a generated file and a newly rendered one.
+//
+// This is used by gen.Generator.WriteWithRemap to figure out which parts
+// of a previously generated file changed, so that hand-edited annotations
+// anchored in the untouched spans (such as "//go:generate" directives,
+// build tags, or "// keep" comments) can be spliced into the new output,
+// keeping the VCS diff of a regenerated file as small as possible.
+package remap
+
+import (
+	"go/scanner"
+	"go/token"
+	"sort"
+)
+
+// Span records a byte range [OldLo, OldHi) of a previous file and the byte
+// range [NewLo, NewHi) of a new file that contain the same run of tokens.
+type Span struct {
+	OldLo, OldHi int
+	NewLo, NewHi int
+}
+
+// Compute tokenizes old and new with go/scanner and returns the sorted
+// list of Spans where the two token streams agree. The gaps between
+// consecutive spans are where old and new diverge: text present in old
+// but absent from new, text newly introduced in new, or both.
+func Compute(old, new []byte) ([]Span, error) {
+	oldToks, err := tokenize(old)
+	if err != nil {
+		return nil, err
+	}
+	newToks, err := tokenize(new)
+	if err != nil {
+		return nil, err
+	}
+
+	spans := align(oldToks, newToks)
+	sort.Slice(spans, func(i, j int) bool { return spans[i].OldLo < spans[j].OldLo })
+	return spans, nil
+}
+
+// tok is a single scanned token, recorded by its literal text, its
+// go/token.Token kind, and the byte offsets it occupies in the source it
+// was scanned from. The kind is tracked separately from lit because
+// go/scanner reports an automatically-inserted semicolon -- the only kind
+// that appears after a top-level declaration in gofmt'd source -- with
+// literal text "\n" rather than ";", so code that needs to recognize a
+// statement terminator can't rely on the literal alone.
+type tok struct {
+	lit    string
+	kind   token.Token
+	lo, hi int
+}
+
+func tokenize(src []byte) ([]tok, error) {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+
+	var errs scanner.ErrorList
+	var s scanner.Scanner
+	s.Init(file, src, func(pos token.Position, msg string) {
+		errs.Add(pos, msg)
+	}, scanner.ScanComments)
+
+	var toks []tok
+	for {
+		pos, t, lit := s.Scan()
+		if t == token.EOF {
+			break
+		}
+		if lit == "" {
+			lit = t.String()
+		}
+		offset := file.Offset(pos)
+		toks = append(toks, tok{lit: lit, kind: t, lo: offset, hi: offset + len(lit)})
+	}
+
+	if len(errs) > 0 {
+		return nil, errs.Err()
+	}
+	return toks, nil
+}
+
+// align walks old and new in lockstep from both ends, matching identical
+// tokens to quickly find the common prefix and suffix, then realigns
+// whatever remains in the middle with a longest-common-subsequence pass.
+// This keeps the common case -- a small change deep inside an otherwise
+// untouched file -- linear, while still handling an arbitrarily reordered
+// middle section correctly.
+//
+// The raw token-by-token prefix/suffix scan above would happily walk past
+// the real edit and into a neighboring declaration whenever a token there
+// -- a "}", a ";", a repeated keyword -- happens to read the same on both
+// sides; nothing about comparing literals tells it that it has wandered
+// out of the declaration the edit lives in. So the fast-path result is
+// rounded in to the nearest declaration boundary before it is used,
+// leaving anything in the declaration the edit touches for lcsAlign to
+// place precisely. Without this, a span could straddle a real edit and an
+// adjacent hand-written annotation, and spliceAnnotations requires a gap
+// to be nothing but the annotation to preserve it.
+func align(old, new []tok) []Span {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix].lit == new[prefix].lit {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix &&
+		old[len(old)-1-suffix].lit == new[len(new)-1-suffix].lit {
+		suffix++
+	}
+
+	if bounds := declBoundaries(old); len(bounds) > 2 {
+		prefix = floorBoundary(bounds, prefix)
+
+		suffixStart := ceilBoundary(bounds, len(old)-suffix)
+		if suffixStart < prefix {
+			suffixStart = prefix
+		}
+		suffix = len(old) - suffixStart
+	}
+
+	var spans []Span
+	if prefix > 0 {
+		spans = append(spans, Span{
+			OldLo: old[0].lo, OldHi: old[prefix-1].hi,
+			NewLo: new[0].lo, NewHi: new[prefix-1].hi,
+		})
+	}
+
+	mid, midNew := old[prefix:len(old)-suffix], new[prefix:len(new)-suffix]
+	if len(mid)*len(midNew) <= maxLCSTokenPairs {
+		spans = append(spans, lcsAlign(mid, midNew)...)
+	}
+	// Above maxLCSTokenPairs, lcsAlign's dp table would be too expensive to
+	// allocate and fill; the diverged middle is left unmatched instead, so
+	// WriteWithRemap falls back to treating that whole region as changed.
+
+	if suffix > 0 {
+		spans = append(spans, Span{
+			OldLo: old[len(old)-suffix].lo, OldHi: old[len(old)-1].hi,
+			NewLo: new[len(new)-suffix].lo, NewHi: new[len(new)-1].hi,
+		})
+	}
+	return spans
+}
+
+// declBoundaries returns the token index immediately following every
+// top-level declaration in toks -- the end of a brace-delimited block, or
+// a bare semicolon, seen while brace depth is zero -- plus a trailing
+// boundary at len(toks). It is a lightweight approximation of Go's
+// top-level declaration structure, using only the handful of token kinds
+// that matter (token.LBRACE, token.RBRACE, token.SEMICOLON), so align can
+// tell a token that merely reads the same from one that is actually part
+// of the untouched declaration on either side of an edit. The semicolon
+// check is done by kind rather than literal because gofmt'd source almost
+// never has an explicit ";" -- the semicolons that close top-level decls
+// are ones go/scanner inserts automatically, and those carry literal "\n".
+func declBoundaries(toks []tok) []int {
+	bounds := []int{0}
+	depth := 0
+	for i, t := range toks {
+		switch t.kind {
+		case token.LBRACE:
+			depth++
+		case token.RBRACE:
+			if depth > 0 {
+				depth--
+			}
+		case token.SEMICOLON:
+			if depth == 0 {
+				bounds = append(bounds, i+1)
+			}
+		}
+	}
+	if bounds[len(bounds)-1] != len(toks) {
+		bounds = append(bounds, len(toks))
+	}
+	return bounds
+}
+
+// floorBoundary returns the largest boundary in the sorted slice bounds
+// that is <= n.
+func floorBoundary(bounds []int, n int) int {
+	best := bounds[0]
+	for _, b := range bounds {
+		if b > n {
+			break
+		}
+		best = b
+	}
+	return best
+}
+
+// ceilBoundary returns the smallest boundary in the sorted slice bounds
+// that is >= n. bounds is assumed to end with a boundary at len(toks), so
+// this always finds one.
+func ceilBoundary(bounds []int, n int) int {
+	for _, b := range bounds {
+		if b >= n {
+			return b
+		}
+	}
+	return bounds[len(bounds)-1]
+}
+
+// maxLCSTokenPairs bounds the size of the dp table lcsAlign allocates,
+// which is len(old)+1 by len(new)+1 int32s: at this bound it is at most a
+// few tens of megabytes and runs in well under a second, but it grows
+// quadratically with the size of the diverged middle, so larger diffs
+// are deliberately left unmatched by align rather than risking multi-
+// second stalls or excessive memory use on a large generated file. A var,
+// rather than a const, so tests can exercise the guard without needing
+// multi-thousand-token fixtures.
+var maxLCSTokenPairs = 4 * 1000 * 1000
+
+// lcsAlign finds the longest common subsequence of token literals between
+// old and new, and returns one Span per maximal run of matched tokens.
+// Callers must keep len(old)*len(new) within maxLCSTokenPairs; see align.
+func lcsAlign(old, new []tok) []Span {
+	if len(old) == 0 || len(new) == 0 {
+		return nil
+	}
+
+	// dp[i][j] holds the length of the LCS of old[i:] and new[j:].
+	dp := make([][]int32, len(old)+1)
+	for i := range dp {
+		dp[i] = make([]int32, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			switch {
+			case old[i].lit == new[j].lit:
+				dp[i][j] = dp[i+1][j+1] + 1
+			case dp[i+1][j] >= dp[i][j+1]:
+				dp[i][j] = dp[i+1][j]
+			default:
+				dp[i][j] = dp[i][j+1]
+			}
+		}
+	}
+
+	var spans []Span
+	i, j := 0, 0
+	for i < len(old) && j < len(new) {
+		switch {
+		case old[i].lit == new[j].lit:
+			lo, hi := i, j
+			for i < len(old) && j < len(new) && old[i].lit == new[j].lit {
+				i++
+				j++
+			}
+			spans = append(spans, Span{
+				OldLo: old[lo].lo, OldHi: old[i-1].hi,
+				NewLo: new[hi].lo, NewHi: new[j-1].hi,
+			})
+		case dp[i+1][j] >= dp[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return spans
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remap
+
+import (
+	"strings"
+	"testing"
+)
+
+// spanText extracts the substring a Span covers from old/new, asserting
+// that both halves agree, the way a correct Span always should.
+func spanText(t *testing.T, old, new []byte, sp Span) string {
+	t.Helper()
+	oldText := string(old[sp.OldLo:sp.OldHi])
+	newText := string(new[sp.NewLo:sp.NewHi])
+	if oldText != newText {
+		t.Fatalf("span %+v covers mismatched text: old %q, new %q", sp, oldText, newText)
+	}
+	return oldText
+}
+
+func TestComputeEditAtStart(t *testing.T) {
+	old := []byte("package foo\n\nfunc A() int { return 1 }\n")
+	new := []byte("package foo\n\nfunc A() int { return 2 }\n")
+
+	spans, err := Compute(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) == 0 {
+		t.Fatal("expected at least one matched span")
+	}
+
+	var covered string
+	for _, sp := range spans {
+		covered += spanText(t, old, new, sp)
+	}
+	if covered == "" {
+		t.Fatal("expected the unchanged prefix to be covered by a span")
+	}
+}
+
+func TestComputeEditInMiddle(t *testing.T) {
+	old := []byte("package foo\n\nfunc A() int { return 1 }\n\nfunc B() int { return 2 }\n")
+	new := []byte("package foo\n\nfunc A() int { return 99 }\n\nfunc B() int { return 2 }\n")
+
+	spans, err := Compute(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sp := range spans {
+		spanText(t, old, new, sp)
+	}
+
+	// "func B() int { return 2 }" is untouched and must show up as its own
+	// span, not merged with func A's closing brace (which also happens to
+	// read "}" but is part of the declaration that was actually edited).
+	var found bool
+	for _, sp := range spans {
+		if strings.TrimSpace(spanText(t, old, new, sp)) == "func B() int { return 2 }" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected the untouched suffix function to be matched as its own span")
+	}
+}
+
+func TestComputeEditAtEnd(t *testing.T) {
+	old := []byte("package foo\n\nfunc A() int { return 1 }\n")
+	new := []byte("package foo\n\nfunc A() int { return 1 }\n\nfunc B() int { return 2 }\n")
+
+	spans, err := Compute(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) == 0 {
+		t.Fatal("expected the unchanged prefix to be covered by a span")
+	}
+	for _, sp := range spans {
+		spanText(t, old, new, sp)
+	}
+}
+
+func TestComputeIdentical(t *testing.T) {
+	src := []byte("package foo\n\nfunc A() int { return 1 }\n")
+	spans, err := Compute(src, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 1 {
+		t.Fatalf("expected the whole file to collapse into a single span, got %+v", spans)
+	}
+	if got := spanText(t, src, src, spans[0]); got != string(src) {
+		t.Fatalf("expected span to cover the entire file, got %q", got)
+	}
+}
+
+// TestAlignSizeGuard exercises the maxLCSTokenPairs guard: once the
+// diverged middle exceeds it, align must skip the O(n·m) DP pass and
+// leave that middle unmatched instead of computing its exact alignment.
+func TestAlignSizeGuard(t *testing.T) {
+	// "c" and "d" are transposed between old and new, so neither prefix
+	// nor suffix matching can absorb them; only the LCS pass in the
+	// middle can find the one token that still lines up.
+	old := []tok{{lit: "x", lo: 0, hi: 1}, {lit: "c", lo: 1, hi: 2}, {lit: "d", lo: 2, hi: 3}, {lit: "y", lo: 3, hi: 4}}
+	new := []tok{{lit: "x", lo: 0, hi: 1}, {lit: "d", lo: 1, hi: 2}, {lit: "c", lo: 2, hi: 3}, {lit: "y", lo: 3, hi: 4}}
+
+	saved := maxLCSTokenPairs
+	defer func() { maxLCSTokenPairs = saved }()
+
+	maxLCSTokenPairs = 10
+	if spans := align(old, new); len(spans) != 3 {
+		t.Fatalf("expected the LCS pass to find the transposed middle within the guard, got %+v", spans)
+	}
+
+	maxLCSTokenPairs = 3
+	if spans := align(old, new); len(spans) != 2 {
+		t.Fatalf("expected only the prefix/suffix spans once the guard is tripped, got %+v", spans)
+	}
+}